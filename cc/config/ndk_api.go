@@ -0,0 +1,193 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"android/soong/android"
+)
+
+const (
+	apiLevelCurrent = "current"
+	apiLevelMinimum = "minimum"
+)
+
+// ApiLevel represents a single NDK API level: a concrete numeric release, the
+// in-progress "current" platform (which has no number yet), or the synthetic
+// "minimum" level used by modules that don't target any specific release.
+//
+// It replaces passing ctx.sdkVersion() around as a bare string, which forced
+// every caller to know how to parse codenames and "current" for itself.
+type ApiLevel struct {
+	value string
+}
+
+// FutureApiLevel is the level of the platform currently being built, used
+// for "current" and for any codename that hasn't been finalized yet.
+func FutureApiLevel() ApiLevel {
+	return ApiLevel{value: apiLevelCurrent}
+}
+
+// MinimumApiLevel is used by modules with no meaningful API level of their
+// own, such as host tools that still route through NDK prebuilt lookups.
+func MinimumApiLevel() ApiLevel {
+	return ApiLevel{value: apiLevelMinimum}
+}
+
+func uncheckedFinalApiLevel(num int) ApiLevel {
+	return ApiLevel{value: strconv.Itoa(num)}
+}
+
+// ApiLevelForNumber wraps a known-valid numeric API level, for callers (such
+// as the list of levels the NDK sysroot is generated for) that already have
+// a concrete number rather than a string to parse.
+func ApiLevelForNumber(num int) ApiLevel {
+	return uncheckedFinalApiLevel(num)
+}
+
+func (l ApiLevel) String() string {
+	return l.value
+}
+
+func (l ApiLevel) IsCurrent() bool {
+	return l.value == apiLevelCurrent
+}
+
+// FinalOrFutureInt returns the numeric API level, or android.FutureApiLevel
+// if this level is "current" or an unreleased codename.
+func (l ApiLevel) FinalOrFutureInt() int {
+	if num, err := strconv.Atoi(l.value); err == nil {
+		return num
+	}
+	return android.FutureApiLevel
+}
+
+func (l ApiLevel) LessThan(other ApiLevel) bool {
+	if l.IsCurrent() || other.IsCurrent() {
+		return !l.IsCurrent() && other.IsCurrent()
+	}
+	return l.FinalOrFutureInt() < other.FinalOrFutureInt()
+}
+
+// ApiLevelFrom parses the string found in a min_sdk_version or sdk_version
+// property: "", "current", a released codename ("O", "P", ...), the literal
+// "minimum", or a concrete numeric level. Codenames are resolved with the
+// table android.ApiLevelsMap builds from build/soong/android/api_levels.go;
+// a codename that isn't in that table yet is assumed to be the in-progress
+// release and resolves to FutureApiLevel rather than failing, so Android.bp
+// files can reference an unreleased codename as soon as it's announced.
+func ApiLevelFrom(ctx android.BaseContext, raw string) (ApiLevel, error) {
+	switch raw {
+	case "", apiLevelCurrent:
+		return FutureApiLevel(), nil
+	case apiLevelMinimum:
+		return MinimumApiLevel(), nil
+	}
+
+	if num, err := strconv.Atoi(raw); err == nil {
+		return uncheckedFinalApiLevel(num), nil
+	}
+
+	if num, ok := android.ApiLevelsMap(ctx.Config())[raw]; ok {
+		return uncheckedFinalApiLevel(num), nil
+	}
+
+	// Letters that aren't in the finalized codename table are assumed to
+	// name the platform currently in development.
+	if len(raw) == 1 && raw[0] >= 'A' && raw[0] <= 'Z' {
+		return FutureApiLevel(), nil
+	}
+
+	return ApiLevel{}, fmt.Errorf("unrecognized API level: %q", raw)
+}
+
+// KnownApiLevels are the numeric API levels the generated NDK sysroot has
+// stub variants for, plus FutureApiLevel() for the in-progress platform.
+// This is the authoritative list both sysroot generation
+// (cc/ndk_sysroot.go's ndkKnownApiLevels) and ApiLevelForArch's validation
+// are built from, so the two can never drift apart.
+var KnownApiLevels = func() []ApiLevel {
+	numbers := []int{9, 14, 15, 16, 17, 18, 19, 21, 23, 24, 26, 27}
+	levels := make([]ApiLevel, 0, len(numbers)+1)
+	for _, n := range numbers {
+		levels = append(levels, ApiLevelForNumber(n))
+	}
+	return append(levels, FutureApiLevel())
+}()
+
+func isKnownApiLevel(level ApiLevel) bool {
+	for _, known := range KnownApiLevels {
+		if known == level {
+			return true
+		}
+	}
+	return false
+}
+
+func knownApiLevelsString() string {
+	strs := make([]string, len(KnownApiLevels))
+	for i, level := range KnownApiLevels {
+		strs[i] = level.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// archMinSupportedApiLevel is the lowest API level the NDK has ever shipped
+// prebuilts for on each architecture. 64-bit ABIs didn't exist until 21.
+var archMinSupportedApiLevel = map[android.ArchType]ApiLevel{
+	android.Arm:    uncheckedFinalApiLevel(9),
+	android.Arm64:  uncheckedFinalApiLevel(21),
+	android.X86:    uncheckedFinalApiLevel(9),
+	android.X86_64: uncheckedFinalApiLevel(21),
+	android.Mips:   uncheckedFinalApiLevel(9),
+	android.Mips64: uncheckedFinalApiLevel(21),
+}
+
+// ApiLevelForArch promotes level up to the lowest level arch has a prebuilt
+// for, warning rather than failing since requesting e.g. 16 on arm64 is a
+// common min_sdk_version copy-paste that shouldn't break the build. It fails
+// the build if arch has no prebuilt at all, or if the resulting level isn't
+// one the sysroot actually has a generated variant for (e.g. a typo'd
+// sdk_version like "99") — both would otherwise only surface much later as a
+// missing file deep in the Ninja graph. MinimumApiLevel() is exempt from the
+// known-level check: it's the sentinel for modules with no real API level of
+// their own, so it never corresponds to a generated sysroot variant.
+func ApiLevelForArch(ctx android.ModuleContext, level ApiLevel, arch android.ArchType) ApiLevel {
+	min, ok := archMinSupportedApiLevel[arch]
+	if !ok {
+		ctx.ModuleErrorf("no NDK prebuilts are available for architecture %q", arch)
+		return level
+	}
+
+	if level.value == apiLevelMinimum {
+		return level
+	}
+
+	if !level.IsCurrent() && level.LessThan(min) {
+		ctx.ModuleWarningf("API level %s has no prebuilts for %s; using %s instead",
+			level, arch, min)
+		level = min
+	}
+
+	if !level.IsCurrent() && !isKnownApiLevel(level) {
+		ctx.ModuleErrorf("API level %s has no NDK prebuilts for %s; supported levels are %s",
+			level, arch, knownApiLevelsString())
+	}
+
+	return level
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"android/soong/android"
+)
+
+// ApiLevelFrom's codename-resolution branch needs a real android.Config to
+// look up android.ApiLevelsMap, so it isn't covered here; "", "current",
+// "minimum", and plain numeric levels all return before touching ctx, so
+// they can be tested directly against a nil android.BaseContext.
+func TestApiLevelFromWithoutCodenames(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want ApiLevel
+	}{
+		{"", FutureApiLevel()},
+		{"current", FutureApiLevel()},
+		{"minimum", MinimumApiLevel()},
+		{"9", ApiLevelForNumber(9)},
+		{"21", ApiLevelForNumber(21)},
+	}
+
+	for _, c := range cases {
+		got, err := ApiLevelFrom(nil, c.raw)
+		if err != nil {
+			t.Errorf("ApiLevelFrom(%q) returned unexpected error: %s", c.raw, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ApiLevelFrom(%q) = %s, want %s", c.raw, got, c.want)
+		}
+	}
+}
+
+func TestApiLevelLessThan(t *testing.T) {
+	cases := []struct {
+		a, b ApiLevel
+		want bool
+	}{
+		{ApiLevelForNumber(9), ApiLevelForNumber(21), true},
+		{ApiLevelForNumber(21), ApiLevelForNumber(9), false},
+		{ApiLevelForNumber(21), ApiLevelForNumber(21), false},
+		{ApiLevelForNumber(27), FutureApiLevel(), true},
+		{FutureApiLevel(), ApiLevelForNumber(27), false},
+		{FutureApiLevel(), FutureApiLevel(), false},
+	}
+
+	for _, c := range cases {
+		if got := c.a.LessThan(c.b); got != c.want {
+			t.Errorf("%s.LessThan(%s) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestApiLevelIsCurrent(t *testing.T) {
+	if !FutureApiLevel().IsCurrent() {
+		t.Error("FutureApiLevel().IsCurrent() = false, want true")
+	}
+	if ApiLevelForNumber(21).IsCurrent() {
+		t.Error("ApiLevelForNumber(21).IsCurrent() = true, want false")
+	}
+	if MinimumApiLevel().IsCurrent() {
+		t.Error("MinimumApiLevel().IsCurrent() = true, want false")
+	}
+}
+
+func TestApiLevelFinalOrFutureInt(t *testing.T) {
+	if got := ApiLevelForNumber(21).FinalOrFutureInt(); got != 21 {
+		t.Errorf("ApiLevelForNumber(21).FinalOrFutureInt() = %d, want 21", got)
+	}
+	if got := FutureApiLevel().FinalOrFutureInt(); got != android.FutureApiLevel {
+		t.Errorf("FutureApiLevel().FinalOrFutureInt() = %d, want android.FutureApiLevel (%d)",
+			got, android.FutureApiLevel)
+	}
+}
+
+func TestKnownApiLevelsIncludesArchMinimums(t *testing.T) {
+	for arch, min := range archMinSupportedApiLevel {
+		if !isKnownApiLevel(min) {
+			t.Errorf("archMinSupportedApiLevel[%s] = %s is not in KnownApiLevels", arch, min)
+		}
+	}
+}
+
+// ApiLevelForArch returns MinimumApiLevel() before touching ctx as long as
+// arch is a real key in archMinSupportedApiLevel, as it is here, so it can be
+// called with a nil android.ModuleContext. Other levels can reach ctx through
+// the promotion warning or the unknown-level error.
+func TestApiLevelForArchAllowsMinimum(t *testing.T) {
+	got := ApiLevelForArch(nil, MinimumApiLevel(), android.Arm)
+	if got != MinimumApiLevel() {
+		t.Errorf("ApiLevelForArch(nil, MinimumApiLevel(), arm) = %s, want %s", got, MinimumApiLevel())
+	}
+}
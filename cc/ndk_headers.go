@@ -0,0 +1,139 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cc
+
+import (
+	"strings"
+
+	"github.com/google/blueprint"
+
+	"android/soong"
+	"android/soong/android"
+	"android/soong/cc/config"
+)
+
+func init() {
+	soong.RegisterModuleType("ndk_headers", ndkHeadersFactory)
+	soong.RegisterModuleType("versioned_ndk_headers", versionedNdkHeadersFactory)
+}
+
+// ndkHeadersProperties are the common Android.bp properties shared by
+// ndk_headers and versioned_ndk_headers.
+type ndkHeadersProperties struct {
+	// Glob of headers to copy into the sysroot, relative to the module
+	// directory.
+	Srcs []string
+
+	// Subdirectory of the module directory the headers are found under.
+	// Stripped from the destination path.
+	From string
+
+	// Subdirectory of usr/include in the sysroot the headers are
+	// installed to.
+	To string
+}
+
+// ndkHeadersLinker is a no-op linker: ndk_headers and versioned_ndk_headers
+// never produce a library, they only stage header files into the sysroot
+// and, via flagExporter, contribute -isystem paths to modules that depend
+// on them.
+type ndkHeadersLinker struct {
+	flagExporter
+
+	properties ndkHeadersProperties
+
+	// versioned is true for versioned_ndk_headers, which ndkApiMutator
+	// expands into one variant per API level. Plain ndk_headers are
+	// API-level agnostic and are left as a single module.
+	versioned bool
+
+	// apiLevel is filled in by ndkApiMutator for versioned_ndk_headers;
+	// it is the zero ApiLevel for plain ndk_headers.
+	apiLevel config.ApiLevel
+}
+
+var _ baseLinkerInterface = (*ndkHeadersLinker)(nil)
+var _ exportedFlagsProducer = (*ndkHeadersLinker)(nil)
+
+func (*ndkHeadersLinker) buildStatic() bool { return false }
+func (*ndkHeadersLinker) buildShared() bool { return false }
+func (*ndkHeadersLinker) setStatic(bool)    {}
+
+func (linker *ndkHeadersLinker) linkerProps() []interface{} {
+	return append(linker.flagExporter.props(), &linker.properties)
+}
+
+func (*ndkHeadersLinker) linkerDeps(ctx BaseModuleContext, deps Deps) Deps {
+	return deps
+}
+
+func (linker *ndkHeadersLinker) link(ctx ModuleContext, flags Flags,
+	deps PathDeps, objFiles android.Paths) android.Path {
+
+	installDir := getGeneratedNdkHeaderDir(ctx, linker.apiLevel)
+	for _, src := range ctx.ExpandSources(linker.properties.Srcs, nil) {
+		installToHeaderSysroot(ctx, installDir, src, linker.properties.From, linker.properties.To)
+	}
+
+	linker.exportIncludes(ctx, "-isystem")
+
+	// Headers don't produce a build artifact of their own; they only
+	// need to exist in the sysroot and export an include path.
+	return nil
+}
+
+func getGeneratedNdkHeaderDir(ctx android.ModuleContext, apiLevel config.ApiLevel) android.OutputPath {
+	if apiLevel == (config.ApiLevel{}) {
+		return getGeneratedNdkSysrootBase(ctx).Join(ctx, "usr", "include")
+	}
+	return android.PathForOutput(ctx, "ndk", "platforms", "android-"+apiLevel.String(), "usr", "include")
+}
+
+// installToHeaderSysroot stages src into dir, rewriting the "from" prefix of
+// its path to "to" the same way the NDK's own header packaging does, so
+// "include/android/foo.h" can be exported as "android/foo.h".
+func installToHeaderSysroot(ctx android.ModuleContext, dir android.OutputPath, src android.Path, from, to string) android.Path {
+	rel := src.Rel()
+	if strings.HasPrefix(rel, from) {
+		rel = strings.TrimPrefix(rel, from)
+	}
+	out := dir.Join(ctx, to, strings.TrimPrefix(rel, "/"))
+	ctx.Build(pctx, android.BuildParams{
+		Rule:        android.Cp,
+		Description: "install NDK header " + out.String(),
+		Input:       src,
+		Output:      out,
+	})
+	return out
+}
+
+func ndkHeadersFactory() (blueprint.Module, []interface{}) {
+	module := newBaseModule(android.DeviceSupported, android.MultilibBoth)
+	module.linker = &ndkHeadersLinker{}
+	module.Properties.HideFromMake = true
+	return module.Init()
+}
+
+func versionedNdkHeadersFactory() (blueprint.Module, []interface{}) {
+	// versioned_ndk_headers is identical to ndk_headers except that
+	// ndkApiMutator expands it into one variant per API level, since
+	// some headers (and the macros they guard) only apply from a given
+	// level onward.
+	module := newBaseModule(android.DeviceSupported, android.MultilibBoth)
+	linker := &ndkHeadersLinker{versioned: true}
+	module.linker = linker
+	module.Properties.HideFromMake = true
+	return module.Init()
+}
@@ -0,0 +1,275 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cc
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"github.com/google/blueprint"
+
+	"android/soong"
+	"android/soong/android"
+	"android/soong/cc/config"
+)
+
+func init() {
+	soong.RegisterModuleType("ndk_library", ndkLibraryFactory)
+}
+
+// A symbolFileLine is a single exported symbol parsed out of a .map.txt
+// symbol file, along with the tags that restrict which (API level, arch)
+// variants it is present in, e.g. "introduced=21", "arm", "x86", "vndk".
+type symbolFileLine struct {
+	symbol string
+	tags   []string
+}
+
+func (l symbolFileLine) introducedAt() string {
+	for _, tag := range l.tags {
+		if strings.HasPrefix(tag, "introduced=") {
+			return strings.TrimPrefix(tag, "introduced=")
+		}
+	}
+	return ""
+}
+
+func (l symbolFileLine) restrictedToArches() []string {
+	var arches []string
+	for _, tag := range l.tags {
+		switch tag {
+		case "arm", "arm64", "x86", "x86_64", "mips", "mips64":
+			arches = append(arches, tag)
+		}
+	}
+	return arches
+}
+
+// parseSymbolFile reads a .map.txt style symbol file and returns the list of
+// exported symbols along with their per-variant tags. The format is a
+// simplified version of the upstream NDK "map" files: one symbol per line,
+// optionally followed by a "#" and a space-separated list of tags.
+func parseSymbolFile(ctx android.ModuleContext, path android.Path) ([]symbolFileLine, error) {
+	f, err := ctx.Fs().Open(path.String())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []symbolFileLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		symbol := text
+		var tags []string
+		if idx := strings.Index(text, "#"); idx != -1 {
+			symbol = strings.TrimSpace(text[:idx])
+			tags = strings.Fields(text[idx+1:])
+		}
+		lines = append(lines, symbolFileLine{symbol: symbol, tags: tags})
+	}
+	return lines, scanner.Err()
+}
+
+// symbolsForVariant filters a parsed symbol file down to the symbols visible
+// at the given API level and architecture.
+func symbolsForVariant(lines []symbolFileLine, apiLevel config.ApiLevel, arch string) []symbolFileLine {
+	var result []symbolFileLine
+	for _, line := range lines {
+		if arches := line.restrictedToArches(); len(arches) > 0 && !stringListContains(arches, arch) {
+			continue
+		}
+		if introduced := line.introducedAt(); introduced != "" {
+			introducedNum, err := strconv.Atoi(introduced)
+			if err == nil && apiLevel.FinalOrFutureInt() < introducedNum {
+				continue
+			}
+		}
+		result = append(result, line)
+	}
+	return result
+}
+
+func stringListContains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ndkLibraryProperties are the Android.bp properties for an ndk_library
+// module: the symbol file that drives stub and sysroot generation for every
+// (API level, arch) variant.
+type ndkLibraryProperties struct {
+	// Symbol file describing the library's exported symbols, in the same
+	// format as the upstream NDK's .map.txt files.
+	Symbol_file string
+
+	// First API level this library was available at. Not read by the
+	// build: ndkApiMutator creates a variant for every level in
+	// config.KnownApiLevels whatever this is set to, and no default is
+	// derived from Symbol_file.
+	First_version string
+
+	// Name of the platform cc_library (libc, libm, libdl, liblog, ...) that
+	// this stub is generated from. Required: it's what ties the generated
+	// sysroot to the current platform sources rather than to whatever
+	// Symbol_file was last hand-edited to claim, and it's the library whose
+	// real symbol table future verification of Symbol_file should diff
+	// against.
+	Platform_library string
+}
+
+// ndkLibraryBackingTag marks the dependency edge from an ndk_library variant
+// to the platform cc_library named in its Platform_library property. It
+// carries no link semantics of its own (the stub never links against the
+// real library); it exists purely so the sysroot generation graph records
+// which platform sources an NDK stub is derived from.
+type ndkLibraryBackingTag struct {
+	blueprint.BaseDependencyTag
+}
+
+var ndkLibraryBackingDepTag ndkLibraryBackingTag
+
+// ndkLibraryLinker generates a stub .so for a single (API level, arch)
+// variant of an ndk_library: an empty-bodied .c stub compiled against a
+// version script, both derived from the same symbol file.
+type ndkLibraryLinker struct {
+	ndkPrebuiltLibraryLinker
+
+	Properties ndkLibraryProperties
+
+	// apiLevel is set by ndkApiMutator once this module has been split
+	// into its per-variant copies.
+	apiLevel config.ApiLevel
+}
+
+var _ baseLinkerInterface = (*ndkLibraryLinker)(nil)
+
+func (ndk *ndkLibraryLinker) linkerProps() []interface{} {
+	return append(ndk.ndkPrebuiltLibraryLinker.linkerProps(), &ndk.Properties)
+}
+
+func (ndk *ndkLibraryLinker) linkerDeps(ctx BaseModuleContext, deps Deps) Deps {
+	// The stub's generated .c file only references libc types and never
+	// symbols from other NDK libraries, so nothing here is actually linked
+	// against. Platform_library is still added as a dependency edge (not to
+	// any Deps list, since it must not be linked) so the backing platform
+	// library is a required, checked property rather than a convention
+	// enforced only by the symbol file's file name.
+	if ndk.Properties.Platform_library == "" {
+		ctx.PropertyErrorf("platform_library",
+			"ndk_library must name the platform cc_library it is generated from")
+	} else {
+		ctx.AddVariationDependencies(nil, ndkLibraryBackingDepTag, ndk.Properties.Platform_library)
+	}
+	return deps
+}
+
+func ndkLibraryFactory() (blueprint.Module, []interface{}) {
+	module := newBaseModule(android.DeviceSupported, android.MultilibBoth)
+	linker := &ndkLibraryLinker{}
+	linker.dynamicProperties.BuildShared = true
+	module.linker = linker
+	module.Properties.HideFromMake = true
+	return module.Init()
+}
+
+// generateStubSource emits the empty-bodied .c source for this variant:
+// every exported function becomes a no-op definition and every exported
+// data symbol becomes a weak zero-initialized definition.
+func (ndk *ndkLibraryLinker) generateStubSource(ctx ModuleContext, symbols []symbolFileLine) android.ModuleGenPath {
+	stubSrc := android.PathForModuleGen(ctx, "stub.c")
+	ctx.Build(pctx, android.BuildParams{
+		Rule:        ndkStubGenRule,
+		Description: "generate NDK stub source for " + ctx.ModuleName(),
+		Output:      stubSrc,
+		Args: map[string]string{
+			"symbols": symbolNames(symbols),
+		},
+	})
+	return stubSrc
+}
+
+func symbolNames(symbols []symbolFileLine) string {
+	names := make([]string, len(symbols))
+	for i, s := range symbols {
+		names[i] = s.symbol
+	}
+	return strings.Join(names, ",")
+}
+
+func (ndk *ndkLibraryLinker) link(ctx ModuleContext, flags Flags,
+	deps PathDeps, objFiles android.Paths) android.Path {
+
+	if ndk.apiLevel == (config.ApiLevel{}) {
+		ctx.ModuleErrorf("ndk_library %q was not expanded by ndkApiMutator", ctx.ModuleName())
+	}
+
+	symbolFile := android.PathForModuleSrc(ctx, ndk.Properties.Symbol_file)
+	allSymbols, err := parseSymbolFile(ctx, symbolFile)
+	if err != nil {
+		ctx.ModuleErrorf("failed to parse symbol file %q: %s", symbolFile, err)
+		return nil
+	}
+
+	symbols := symbolsForVariant(allSymbols, ndk.apiLevel, ctx.Arch().ArchType.String())
+	stubSrc := ndk.generateStubSource(ctx, symbols)
+	versionScript := ndk.generateVersionScript(ctx, symbols)
+
+	objPath := ndk.compileStub(ctx, flags, stubSrc)
+	sharedLib := android.PathForModuleOut(ctx, ctx.ModuleName()+flags.Toolchain.ShlibSuffix())
+	ndk.linkStub(ctx, flags, objPath, versionScript, sharedLib)
+
+	return ndk.installToSysroot(ctx, flags.Toolchain, sharedLib)
+}
+
+func (ndk *ndkLibraryLinker) generateVersionScript(ctx ModuleContext, symbols []symbolFileLine) android.ModuleGenPath {
+	versionScript := android.PathForModuleGen(ctx, "stub.map")
+	ctx.Build(pctx, android.BuildParams{
+		Rule:        ndkVersionScriptRule,
+		Description: "generate NDK version script for " + ctx.ModuleName(),
+		Output:      versionScript,
+		Args: map[string]string{
+			"symbols": symbolNames(symbols),
+		},
+	})
+	return versionScript
+}
+
+func (ndk *ndkLibraryLinker) compileStub(ctx ModuleContext, flags Flags, src android.ModuleGenPath) android.Path {
+	return compileNdkStubSource(ctx, flags, src)
+}
+
+func (ndk *ndkLibraryLinker) linkStub(ctx ModuleContext, flags Flags, obj, versionScript, out android.Path) {
+	linkNdkStubSharedLibrary(ctx, flags, obj, versionScript, out)
+}
+
+// installToSysroot stages the generated stub library under the ndk_api
+// variant's slice of the sysroot, so getNdkLibDir can find it without any
+// prebuilts/ndk checkout. toolchain is threaded through to
+// getGeneratedNdkLibDir so the staged path agrees with where getNdkLibDir
+// will later look for it (lib vs lib64).
+func (ndk *ndkLibraryLinker) installToSysroot(ctx ModuleContext, toolchain config.Toolchain, lib android.Path) android.Path {
+	installDir := getGeneratedNdkLibDir(ctx, toolchain, ndk.apiLevel)
+	return installToSysrootDir(ctx, installDir, lib)
+}
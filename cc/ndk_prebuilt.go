@@ -16,6 +16,7 @@ package cc
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	"github.com/google/blueprint"
@@ -30,6 +31,7 @@ func init() {
 	soong.RegisterModuleType("ndk_prebuilt_object", ndkPrebuiltObjectFactory)
 	soong.RegisterModuleType("ndk_prebuilt_static_stl", ndkPrebuiltStaticStlFactory)
 	soong.RegisterModuleType("ndk_prebuilt_shared_stl", ndkPrebuiltSharedStlFactory)
+	soong.RegisterModuleType("ndk_prebuilt_headers", ndkPrebuiltHeadersFactory)
 }
 
 // NDK prebuilt libraries.
@@ -38,24 +40,36 @@ func init() {
 // either (with the exception of the shared STLs, which are installed to the app's directory rather
 // than to the system image).
 
-func getNdkLibDir(ctx android.ModuleContext, toolchain config.Toolchain, version string) android.SourcePath {
-	suffix := ""
-	// Most 64-bit NDK prebuilts store libraries in "lib64", except for arm64 which is not a
-	// multilib toolchain and stores the libraries in "lib".
-	if toolchain.Is64Bit() && ctx.Arch().ArchType != android.Arm64 {
-		suffix = "64"
+func getNdkLibDir(ctx android.ModuleContext, toolchain config.Toolchain, apiLevel config.ApiLevel) android.OutputPath {
+	// The sysroot used to be a checked-in prebuilts/ndk/current tree; it's now generated from
+	// platform sources by ndk_library/ndk_headers modules via ndkApiMutator, so resolve against
+	// the staged output directory instead. getGeneratedNdkLibDir applies the same lib64 placement
+	// this used to compute here, so the generator and this lookup can't disagree on where a given
+	// toolchain's stubs land.
+	return getGeneratedNdkLibDir(ctx, toolchain, apiLevel)
+}
+
+// resolveNdkApiLevel parses the raw sdk_version/min_sdk_version string for
+// ctx's module and promotes it up to the lowest level the NDK has a prebuilt
+// for on ctx's architecture. Every NDK prebuilt lookup should go through
+// this rather than using ctx.sdkVersion() directly, so that codenames,
+// "current", and too-low levels are all handled the same way everywhere.
+func resolveNdkApiLevel(ctx android.ModuleContext, raw string) config.ApiLevel {
+	level, err := config.ApiLevelFrom(ctx, raw)
+	if err != nil {
+		ctx.PropertyErrorf("sdk_version", "%s", err)
+		return config.FutureApiLevel()
 	}
-	return android.PathForSource(ctx, fmt.Sprintf("prebuilts/ndk/current/platforms/android-%s/arch-%s/usr/lib%s",
-		version, toolchain.Name(), suffix))
+	return config.ApiLevelForArch(ctx, level, ctx.Arch().ArchType)
 }
 
 func ndkPrebuiltModuleToPath(ctx android.ModuleContext, toolchain config.Toolchain,
-	ext string, version string) android.Path {
+	ext string, apiLevel config.ApiLevel) android.Path {
 
 	// NDK prebuilts are named like: ndk_NAME.EXT.SDK_VERSION.
 	// We want to translate to just NAME.EXT
 	name := strings.Split(strings.TrimPrefix(ctx.ModuleName(), "ndk_"), ".")[0]
-	dir := getNdkLibDir(ctx, toolchain, version)
+	dir := getNdkLibDir(ctx, toolchain, apiLevel)
 	return dir.Join(ctx, name+ext)
 }
 
@@ -82,7 +96,7 @@ func (c *ndkPrebuiltObjectLinker) link(ctx ModuleContext, flags Flags,
 		ctx.ModuleErrorf("NDK prebuilts must have an ndk_crt prefixed name")
 	}
 
-	return ndkPrebuiltModuleToPath(ctx, flags.Toolchain, objectExtension, ctx.sdkVersion())
+	return ndkPrebuiltModuleToPath(ctx, flags.Toolchain, objectExtension, resolveNdkApiLevel(ctx, ctx.sdkVersion()))
 }
 
 type ndkPrebuiltLibraryLinker struct {
@@ -116,15 +130,77 @@ func (ndk *ndkPrebuiltLibraryLinker) link(ctx ModuleContext, flags Flags,
 	ndk.exportIncludes(ctx, "-isystem")
 
 	return ndkPrebuiltModuleToPath(ctx, flags.Toolchain, flags.Toolchain.ShlibSuffix(),
-		ctx.sdkVersion())
+		resolveNdkApiLevel(ctx, ctx.sdkVersion()))
+}
+
+// The NDK STL is slightly different from the prebuilt system libraries:
+//     * Is not specific to each platform version.
+//     * The library is not in a predictable location relative to the other prebuilts.
+//
+// libstlport and libgnustl are gone from upstream NDK releases, so libc++ is the only
+// STL this supports.
+
+// ndkAbiDirs maps an arch to the ABI directory name its NDK STL prebuilts are shipped
+// under. This used to be read off of ctx.Arch().Abi[0], which is wrong for arm (it
+// names the legacy "armeabi" ABI, not "armeabi-v7a", for anything built with the
+// modern toolchain) and for x86_64 (which isn't covered by ctx.Arch().Abi at all on a
+// 32-bit-primary multilib product).
+var ndkAbiDirs = map[android.ArchType]string{
+	android.Arm:    "armeabi-v7a",
+	android.Arm64:  "arm64-v8a",
+	android.X86:    "x86",
+	android.X86_64: "x86_64",
+	android.Mips:   "mips",
+	android.Mips64: "mips64",
 }
 
-// The NDK STLs are slightly different from the prebuilt system libraries:
-//     * Are not specific to each platform version.
-//     * The libraries are not in a predictable location for each STL.
+func ndkAbiDir(ctx android.ModuleContext) string {
+	abi, ok := ndkAbiDirs[ctx.Arch().ArchType]
+	if !ok {
+		ctx.ModuleErrorf("no NDK STL prebuilts for architecture %q", ctx.Arch().ArchType)
+	}
+	return abi
+}
+
+// ndkPrebuiltStlProperties names which STL variant a ndk_prebuilt_static_stl or
+// ndk_prebuilt_shared_stl module provides. It exists so the STL family never has to be
+// recovered by trimming a "_shared"/"_static" suffix off of the module name, which broke
+// as soon as a library's own name happened to end the same way.
+type ndkPrebuiltStlProperties struct {
+	// The STL this module provides a prebuilt of. Only "libc++" is supported.
+	Stl string
+}
 
 type ndkPrebuiltStlLinker struct {
 	ndkPrebuiltLibraryLinker
+
+	StlProperties ndkPrebuiltStlProperties
+}
+
+func (ndk *ndkPrebuiltStlLinker) linkerProps() []interface{} {
+	return append(ndk.ndkPrebuiltLibraryLinker.linkerProps(), &ndk.StlProperties)
+}
+
+// unwinderStaticLibs are the additional static archives a static libc++ must also link:
+// libc++abi.a everywhere, plus libunwind.a on arm32 (the only ABI whose libc doesn't
+// already provide a system unwinder).
+func unwinderStaticLibs(arch android.ArchType) []string {
+	libs := []string{"libc++abi"}
+	if arch == android.Arm {
+		libs = append(libs, "libunwind")
+	}
+	return libs
+}
+
+func (ndk *ndkPrebuiltStlLinker) linkerDeps(ctx BaseModuleContext, deps Deps) Deps {
+	if ndk.dynamicProperties.BuildStatic {
+		// Synthesized inter-variant deps: the unwinder is itself shipped as an
+		// ndk_prebuilt_object/static archive rather than linked directly here, so that
+		// it follows the same toolchain-driven path resolution as every other NDK
+		// prebuilt.
+		deps.WholeStaticLibs = append(deps.WholeStaticLibs, unwinderStaticLibs(ctx.Arch().ArchType)...)
+	}
+	return deps
 }
 
 func ndkPrebuiltSharedStlFactory() (blueprint.Module, []interface{}) {
@@ -145,46 +221,186 @@ func ndkPrebuiltStaticStlFactory() (blueprint.Module, []interface{}) {
 	return module.Init()
 }
 
-func getNdkStlLibDir(ctx android.ModuleContext, toolchain config.Toolchain, stl string) android.SourcePath {
-	gccVersion := toolchain.GccVersion()
-	var libDir string
-	switch stl {
-	case "libstlport":
-		libDir = "cxx-stl/stlport/libs"
-	case "libc++":
-		libDir = "cxx-stl/llvm-libc++/libs"
-	case "libgnustl":
-		libDir = fmt.Sprintf("cxx-stl/gnu-libstdc++/%s/libs", gccVersion)
+func getNdkStlLibDir(ctx android.ModuleContext, stl string) android.SourcePath {
+	if stl != "libc++" {
+		ctx.ModuleErrorf("unknown NDK STL: %s (only libc++ is supported)", stl)
+		return android.PathForSource(ctx, "")
 	}
 
-	if libDir != "" {
-		ndkSrcRoot := "prebuilts/ndk/current/sources"
-		return android.PathForSource(ctx, ndkSrcRoot).Join(ctx, libDir, ctx.Arch().Abi[0])
-	}
-
-	ctx.ModuleErrorf("Unknown NDK STL: %s", stl)
-	return android.PathForSource(ctx, "")
+	ndkSrcRoot := "prebuilts/ndk/current/sources/cxx-stl/llvm-libc++/libs"
+	return android.PathForSource(ctx, ndkSrcRoot).Join(ctx, ndkAbiDir(ctx))
 }
 
 func (ndk *ndkPrebuiltStlLinker) link(ctx ModuleContext, flags Flags,
 	deps PathDeps, objFiles android.Paths) android.Path {
 	// A null build step, but it sets up the output path.
-	if !strings.HasPrefix(ctx.ModuleName(), "ndk_lib") {
-		ctx.ModuleErrorf("NDK prebuilts must have an ndk_lib prefixed name")
-	}
-
 	ndk.exportIncludes(ctx, "-I")
 
-	libName := strings.TrimPrefix(ctx.ModuleName(), "ndk_")
+	// The on-disk libs under cxx-stl/llvm-libc++/libs/<abi>/ are named
+	// libc++_shared.so and libc++_static.a, not libc++.so/libc++.a, so the
+	// variant suffix has to be appended to the file name even though
+	// StlProperties.Stl itself is just "libc++".
 	libExt := flags.Toolchain.ShlibSuffix()
+	libVariant := "_shared"
 	if ndk.dynamicProperties.BuildStatic {
 		libExt = staticLibraryExtension
+		libVariant = "_static"
+	}
+
+	libDir := getNdkStlLibDir(ctx, ndk.StlProperties.Stl)
+	lib := libDir.Join(ctx, ndk.StlProperties.Stl+libVariant+libExt)
+
+	if !ndk.dynamicProperties.BuildStatic {
+		// Unlike the rest of the NDK prebuilts, the shared STL is installed to the
+		// APK's own lib/<abi>/ directory rather than to the system image, since an
+		// app that statically selects libc++_shared needs its own private copy.
+		return ndk.installToApkLibDir(ctx, lib)
 	}
 
-	stlName := strings.TrimSuffix(libName, "_shared")
-	stlName = strings.TrimSuffix(stlName, "_static")
-	libDir := getNdkStlLibDir(ctx, flags.Toolchain, stlName)
-	return libDir.Join(ctx, libName+libExt)
+	return lib
+}
+
+// installToApkLibDir stages lib for packaging into an APK's lib/<abi>/ directory. It
+// deliberately doesn't go through the normal system-image install path: the shared STL
+// is never installed to /system, only ever bundled with the apps that request it.
+func (ndk *ndkPrebuiltStlLinker) installToApkLibDir(ctx ModuleContext, lib android.Path) android.Path {
+	out := android.PathForModuleOut(ctx, "lib", ndkAbiDir(ctx), lib.Base())
+	ctx.Build(pctx, android.BuildParams{
+		Rule:        android.Cp,
+		Description: "install " + lib.Base() + " for packaging into APKs",
+		Input:       lib,
+		Output:      out,
+	})
+	return out
+}
+
+// ndkHeaderApiLevelFilter excludes a single header (named by its path under
+// usr/include, To prefix included) or
+// library (named by module name) at a specific set of API levels. It's the
+// shared shape behind ndkPrebuiltHeadersProperties' Skip_libraries and
+// Skip_headers: a bare list of names couldn't express "skip this only below
+// API 24", which is exactly the case a header shipped ahead of its
+// ndk_library stub needs.
+type ndkHeaderApiLevelFilter struct {
+	Name       string
+	Api_levels []string
+}
+
+func (f ndkHeaderApiLevelFilter) appliesAt(apiLevel config.ApiLevel) bool {
+	for _, level := range f.Api_levels {
+		if level == apiLevel.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// ndkPrebuiltHeadersProperties are the Android.bp properties for an
+// ndk_prebuilt_headers module.
+type ndkPrebuiltHeadersProperties struct {
+	// Header files to copy into the sysroot, relative to the module directory.
+	Srcs []string
+
+	// Subdirectory of the module directory the headers are found under,
+	// stripped from the destination path, e.g. "include".
+	From string
+
+	// Subdirectory of the sysroot's usr/include the headers are exported
+	// to, e.g. "android" to turn "include/foo.h" into "android/foo.h".
+	To string
+
+	// API levels at which this module exports nothing. An entry applies
+	// only when its Name is this module's own name: at the listed levels
+	// no headers are staged and no include path is exported. Entries
+	// naming any other module have no effect.
+	Skip_libraries []ndkHeaderApiLevelFilter
+
+	// Individual header files (named by their path under usr/include, To
+	// prefix included, e.g. "android/foo.h") that should not be
+	// exported at the listed API levels, for a header that only replaces
+	// part of what an older prebuilt shipped.
+	Skip_headers []ndkHeaderApiLevelFilter
+}
+
+// ndkPrebuiltHeadersLinker is a no-op linker: ndk_prebuilt_headers never
+// produces a library, it only contributes -isystem paths (and optionally
+// -D flags) to dependents via flagExporter, so headers can be shipped ahead
+// of the ndk_prebuilt_library stub that will eventually declare their
+// symbols.
+type ndkPrebuiltHeadersLinker struct {
+	flagExporter
+
+	Properties ndkPrebuiltHeadersProperties
+}
+
+var _ baseLinkerInterface = (*ndkPrebuiltHeadersLinker)(nil)
+var _ exportedFlagsProducer = (*ndkPrebuiltHeadersLinker)(nil)
+
+func (*ndkPrebuiltHeadersLinker) buildStatic() bool { return false }
+func (*ndkPrebuiltHeadersLinker) buildShared() bool { return false }
+func (*ndkPrebuiltHeadersLinker) setStatic(bool)    {}
+
+func (linker *ndkPrebuiltHeadersLinker) linkerProps() []interface{} {
+	return append(linker.flagExporter.props(), &linker.Properties)
+}
+
+func (*ndkPrebuiltHeadersLinker) linkerDeps(ctx BaseModuleContext, deps Deps) Deps {
+	return deps
+}
+
+func (linker *ndkPrebuiltHeadersLinker) headerSkippedForApiLevel(name string, apiLevel config.ApiLevel) bool {
+	for _, skip := range linker.Properties.Skip_headers {
+		if skip.Name == name && skip.appliesAt(apiLevel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (linker *ndkPrebuiltHeadersLinker) link(ctx ModuleContext, flags Flags,
+	deps PathDeps, objFiles android.Paths) android.Path {
+
+	apiLevel := resolveNdkApiLevel(ctx, ctx.sdkVersion())
+
+	for _, skip := range linker.Properties.Skip_libraries {
+		if skip.Name == ctx.ModuleName() && skip.appliesAt(apiLevel) {
+			return nil
+		}
+	}
+
+	// Stage each header under usr/include/<To>/, rewriting its path the
+	// same way ndk_headers does: the From prefix is stripped and the To
+	// prefix is substituted, so e.g. "include/android/foo.h" with
+	// From: "include", To: "android" is exported as "android/foo.h".
+	// Headers matching Skip_headers at this API level are left out of the
+	// sysroot entirely rather than just hidden from the include path, so a
+	// later, unrelated header can't shadow one that was never supposed to
+	// exist yet.
+	installDir := getGeneratedNdkSysrootBase(ctx).Join(ctx, "usr", "include")
+	for _, src := range ctx.ExpandSources(linker.Properties.Srcs, nil) {
+		rel := src.Rel()
+		if strings.HasPrefix(rel, linker.Properties.From) {
+			rel = strings.TrimPrefix(rel, linker.Properties.From)
+		}
+		name := filepath.Join(linker.Properties.To, strings.TrimPrefix(rel, "/"))
+		if linker.headerSkippedForApiLevel(name, apiLevel) {
+			continue
+		}
+		installToHeaderSysroot(ctx, installDir, src, linker.Properties.From, linker.Properties.To)
+	}
+
+	linker.flagExporter.Properties.Export_include_dirs =
+		append(linker.flagExporter.Properties.Export_include_dirs, installDir)
+	linker.exportIncludes(ctx, "-isystem")
+
+	return nil
+}
+
+func ndkPrebuiltHeadersFactory() (blueprint.Module, []interface{}) {
+	module := newBaseModule(android.DeviceSupported, android.MultilibBoth)
+	module.linker = &ndkPrebuiltHeadersLinker{}
+	module.Properties.HideFromMake = true
+	return module.Init()
 }
 
 func linkageMutator(mctx android.BottomUpMutatorContext) {
@@ -0,0 +1,162 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cc
+
+import (
+	"github.com/google/blueprint"
+
+	"android/soong/android"
+	"android/soong/cc/config"
+)
+
+// ndkStubGenRule turns the list of symbols visible in one (API level, arch)
+// variant into a stub .c source: an empty-bodied definition for every
+// function symbol and a weak zero-initialized definition for every data
+// symbol. The actual text substitution is done by a small host tool
+// (ndkstubgen) rather than inline shell, since the real NDK symbol list
+// syntax (e.g. "var", wildcard arches) is richer than what's shown here.
+var ndkStubGenRule = pctx.StaticRule("ndkStubGenRule", blueprint.RuleParams{
+	Command:     `${ndkStubGenCmd} --symbols "${symbols}" --out ${out}`,
+	CommandDeps: []string{"${ndkStubGenCmd}"},
+}, "symbols")
+
+// ndkVersionScriptRule emits a linker version script restricting the stub
+// .so's dynamic symbol table to exactly the symbols visible in this variant.
+var ndkVersionScriptRule = pctx.StaticRule("ndkVersionScriptRule", blueprint.RuleParams{
+	Command:     `${ndkGenVersionScriptCmd} --symbols "${symbols}" --out ${out}`,
+	CommandDeps: []string{"${ndkGenVersionScriptCmd}"},
+}, "symbols")
+
+func init() {
+	// Must run before linkageMutator (registered alongside it in cc.init,
+	// as "ndk_api" -> "link") so that the static/shared split in
+	// linkageMutator operates per API-level variant.
+	android.RegisterBottomUpMutator("ndk_api", ndkApiMutator).Parallel()
+}
+
+// ndkKnownApiLevels are the numeric API levels the generated sysroot has
+// stub variants for, plus config.FutureApiLevel() for the in-progress
+// platform. This is just config.KnownApiLevels under the local name this
+// file used before that list moved to cc/config so ApiLevelForArch could
+// validate against it too; the two must stay the same list or modules could
+// pass validation for a level the sysroot was never generated for.
+var ndkKnownApiLevels = config.KnownApiLevels
+
+func ndkKnownApiLevelStrings() []string {
+	strs := make([]string, len(ndkKnownApiLevels))
+	for i, level := range ndkKnownApiLevels {
+		strs[i] = level.String()
+	}
+	return strs
+}
+
+// ndkApiMutator splits every ndk_library and versioned_ndk_headers module
+// into one variant per supported API level. Plain ndk_headers modules are
+// left as a single variant.
+// Each variant generates or packages the slice of the sysroot that
+// corresponds to its level, so it must run before linkageMutator splits the
+// library further into its static/shared variants.
+func ndkApiMutator(mctx android.BottomUpMutatorContext) {
+	module, ok := mctx.Module().(*Module)
+	if !ok || module.linker == nil {
+		return
+	}
+
+	switch linker := module.linker.(type) {
+	case *ndkLibraryLinker:
+	case *ndkHeadersLinker:
+		if !linker.versioned {
+			return
+		}
+	default:
+		return
+	}
+
+	modules := mctx.CreateVariations(ndkKnownApiLevelStrings()...)
+	for i, m := range modules {
+		switch linker := m.(*Module).linker.(type) {
+		case *ndkLibraryLinker:
+			linker.apiLevel = ndkKnownApiLevels[i]
+		case *ndkHeadersLinker:
+			linker.apiLevel = ndkKnownApiLevels[i]
+		}
+	}
+}
+
+// getGeneratedNdkLibDir returns the directory that a generated stub library
+// for the given API level variant is installed to. This replaces the
+// checked-in prebuilts/ndk/current tree as the thing getNdkLibDir ultimately
+// resolves against, so it must apply the same lib64 placement getNdkLibDir
+// expects to find things at: most 64-bit toolchains use "lib64", except
+// arm64, which isn't a multilib toolchain and uses "lib".
+func getGeneratedNdkLibDir(ctx android.ModuleContext, toolchain config.Toolchain, apiLevel config.ApiLevel) android.OutputPath {
+	libDir := "lib"
+	if toolchain.Is64Bit() && ctx.Arch().ArchType != android.Arm64 {
+		libDir = "lib64"
+	}
+	return android.PathForOutput(ctx, "ndk", "platforms", "android-"+apiLevel.String(),
+		"arch-"+ctx.Arch().ArchType.String(), "usr", libDir)
+}
+
+func getGeneratedNdkSysrootBase(ctx android.ModuleContext) android.OutputPath {
+	return android.PathForOutput(ctx, "ndk", "sysroot")
+}
+
+// installToSysrootDir copies src into dir, returning the path of the copy.
+// Stub libraries aren't stripped or otherwise transformed on the way in;
+// the rule is a plain copy so that dir always reflects exactly what was
+// last built from source.
+func installToSysrootDir(ctx android.ModuleContext, dir android.OutputPath, src android.Path) android.Path {
+	out := dir.Join(ctx, src.Base())
+	ctx.Build(pctx, android.BuildParams{
+		Rule:        android.Cp,
+		Description: "install " + out.String() + " to NDK sysroot",
+		Input:       src,
+		Output:      out,
+	})
+	return out
+}
+
+// compileNdkStubSource compiles the generated stub .c into an object file
+// using the same toolchain flags as any other cc module, so the stub stays
+// consistent with whatever the platform currently builds with.
+func compileNdkStubSource(ctx ModuleContext, flags Flags, src android.Path) android.Path {
+	obj := android.PathForModuleOut(ctx, "stub.o")
+	ctx.Build(pctx, android.BuildParams{
+		Rule:        cc,
+		Description: "compile NDK stub for " + ctx.ModuleName(),
+		Input:       src,
+		Output:      obj,
+		Args: map[string]string{
+			"cFlags": flags.GlobalFlags + " " + flags.CFlags,
+		},
+	})
+	return obj
+}
+
+// linkNdkStubSharedLibrary links the compiled stub object into a .so
+// constrained to the symbols listed in versionScript.
+func linkNdkStubSharedLibrary(ctx ModuleContext, flags Flags, obj, versionScript, out android.Path) {
+	ctx.Build(pctx, android.BuildParams{
+		Rule:        ld,
+		Description: "link NDK stub " + out.String(),
+		Input:       obj,
+		Implicit:    versionScript,
+		Output:      out,
+		Args: map[string]string{
+			"ldFlags": flags.GlobalFlags + " -Wl,--version-script," + versionScript.String() + " -shared",
+		},
+	})
+}